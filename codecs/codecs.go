@@ -1,11 +1,10 @@
 // The codec package defines the codec that is used to ensure certain
 // format restrictions when creating responses from our API.  We have
 // a few formats that create different types of metadata in the
-// response.  Right now, because of restrictions within the
-// stretchr/goweb and stretchr/codecs package, our codec package only
-// supports json, and it only checks to make sure that the response is
-// formatted properly before returning.  It doesn't do any formatting
-// itself, just yet.
+// response.  Our encapsulation codec itself doesn't encode anything;
+// it builds the meta/notifications/response envelope and then defers
+// to whichever base codec (json, protobuf, msgpack, grpc+json, ...)
+// was negotiated for the "+suffix" on the request's mime type.
 package codecs
 
 import (
@@ -14,8 +13,9 @@ import (
 	"github.com/Radiobox/web_responders"
 	"github.com/stretchr/goweb"
 	"github.com/stretchr/objx"
-	"log"
+	"net/url"
 	"path"
+	"strconv"
 	"strings"
 )
 
@@ -26,73 +26,239 @@ const (
 	defaultBaseType = "application/json"
 )
 
+// baseCodecTypes is the allow-list of encapsulation suffixes we know how
+// to re-encode the envelope through, mapped to the mime type of the
+// actual base codec registered with goweb.CodecService.  This replaces
+// blindly concatenating "application/" with whatever suffix showed up
+// on matched_type, which falls apart for compound suffixes such as
+// "grpc+json".
+var baseCodecTypes = map[string]string{
+	"json":       defaultBaseType,
+	"proto":      "application/vnd.google.protobuf",
+	"protobuf":   "application/vnd.google.protobuf",
+	"msgpack":    "application/x-msgpack",
+	"grpc+json":  "application/grpc+json",
+	"grpc+proto": "application/grpc+proto",
+}
+
+// Codec is the subset of stretchr/codecs.Codec that we need in order to
+// re-encode the constructed envelope through whichever base codec
+// content negotiation landed on.
+type Codec interface {
+	Marshal(object interface{}, options map[string]interface{}) ([]byte, error)
+	Unmarshal(data []byte, obj interface{}) error
+	ContentType() string
+}
+
+// RadioboxApiCodec wraps a response in our encapsulation format, then
+// defers the actual marshaling to whichever base codec corresponds to
+// the "+suffix" on the negotiated mime type.  A zero-value
+// RadioboxApiCodec (suffix == "") is the generic registration that
+// matches any "application/vnd.radiobox.encapsulated+*" mime type via
+// ContentTypeSupported; the suffix-specific registrations added by
+// AddCodecs let goweb's content negotiation offer each encapsulation
+// explicitly.
 type RadioboxApiCodec struct {
+	suffix string
 }
 
+// CreateConstructor builds the function that wraps a response in our
+// meta/notifications/response envelope.  Called with
+// web_responders.ElementLinksOnly as the object, it instead just
+// returns {"links": ...} holding originalObject's links (or nil when
+// it has none) - the shape
+// createSliceResponse uses to attach a "links" sub-object to each
+// element of a slice response without wrapping every element in its
+// own envelope; any other object, including a literal nil from a
+// handler that legitimately responds with no data, builds the full
+// top-level envelope.
 func (codec *RadioboxApiCodec) CreateConstructor(options map[string]interface{}) func(interface{}, interface{}) interface{} {
 	return func(object interface{}, originalObject interface{}) interface{} {
-		var links map[string]string
-		if linker, ok := originalObject.(web_responders.RelatedLinker); ok {
-			links = linker.RelatedLinks()
-		} else {
-			links = map[string]string{}
+		elementLinksOnly := object == web_responders.ElementLinksOnly
+
+		// Only the top-level call gets the request-path "self"
+		// fallback; an element only gets a self link if it implements
+		// RelatedLinker with a resource URL of its own, since the
+		// request path is the collection's URL, not any one element's.
+		links := relatedLinks(originalObject, options, !elementLinksOnly)
+
+		if elementLinksOnly {
+			if len(links) == 0 {
+				return nil
+			}
+			return map[string]interface{}{"links": links}
 		}
-		protocol := options["protocol"].(string)
-		host := options["host"].(string)
-		for rel, link := range links {
-			fullLink := path.Join(host, link)
-			links[rel] = fmt.Sprintf("%s://%s", protocol, fullLink)
+
+		meta := map[string]interface{}{
+			"code":         options["status"],
+			"input_params": options["input_params"],
+			"links":        links,
 		}
+		addPaginationMeta(meta, originalObject, options)
 
-		response := map[string]interface{}{
-			"meta": map[string]interface{}{
-				"code":         options["status"],
-				"input_params": options["input_params"],
-				"links":        links,
-			},
+		return map[string]interface{}{
+			"meta":          meta,
 			"notifications": options["notifications"],
 			"response":      object,
 		}
-		return response
 	}
 }
 
+// relatedLinks resolves originalObject's fully-qualified links: its own
+// RelatedLinks(), if it implements web_responders.RelatedLinker, plus -
+// only when includePathFallback is set - a "self" link derived from the
+// request URL (options["path"]) if one wasn't already declared.  The
+// path fallback only makes sense for the top-level response, which is
+// actually at that URL; an element of a slice response has no URL of
+// its own beyond what its own RelatedLinks() declares, so
+// CreateConstructor only passes includePathFallback for the top-level
+// call.
+func relatedLinks(originalObject interface{}, options map[string]interface{}, includePathFallback bool) map[string]string {
+	links := map[string]string{}
+	if linker, ok := originalObject.(web_responders.RelatedLinker); ok {
+		for rel, link := range linker.RelatedLinks() {
+			links[rel] = link
+		}
+	}
+
+	protocol, _ := options["protocol"].(string)
+	host, _ := options["host"].(string)
+	for rel, link := range links {
+		links[rel] = fmt.Sprintf("%s://%s", protocol, path.Join(host, link))
+	}
+
+	if includePathFallback {
+		if _, ok := links["self"]; !ok {
+			if requestPath, ok := options["path"].(string); ok {
+				links["self"] = fmt.Sprintf("%s://%s", protocol, path.Join(host, requestPath))
+			}
+		}
+	}
+	return links
+}
+
+// Paginator lets a top-level response object describe its place in a
+// paginated collection.  CreateConstructor uses it to add page,
+// per_page, total and next/prev/first/last links to meta - the
+// pagination shape most HAL/JSON:API-style clients expect.
+type Paginator interface {
+	Page() int
+	PerPage() int
+	Total() int64
+}
+
+// addPaginationMeta adds page/per_page/total and next/prev/first/last
+// links to meta when originalObject implements Paginator; it's a
+// no-op otherwise.
+func addPaginationMeta(meta map[string]interface{}, originalObject interface{}, options map[string]interface{}) {
+	paginator, ok := originalObject.(Paginator)
+	if !ok {
+		return
+	}
+	protocol, _ := options["protocol"].(string)
+	host, _ := options["host"].(string)
+	requestPath, _ := options["path"].(string)
+
+	page, perPage, total := paginator.Page(), paginator.PerPage(), paginator.Total()
+	lastPage := 1
+	if perPage > 0 {
+		if pages := (total + int64(perPage) - 1) / int64(perPage); pages > 1 {
+			lastPage = int(pages)
+		}
+	}
+
+	meta["page"] = page
+	meta["per_page"] = perPage
+	meta["total"] = total
+	meta["first"] = paginationPageURL(protocol, host, requestPath, 1)
+	meta["last"] = paginationPageURL(protocol, host, requestPath, lastPage)
+	if page > 1 {
+		meta["prev"] = paginationPageURL(protocol, host, requestPath, page-1)
+	}
+	if page < lastPage {
+		meta["next"] = paginationPageURL(protocol, host, requestPath, page+1)
+	}
+}
+
+// paginationPageURL rewrites requestPath's "page" query param to page,
+// so pagination links point back at the same endpoint and filters.
+func paginationPageURL(protocol, host, requestPath string, page int) string {
+	parsed, err := url.Parse(requestPath)
+	if err != nil {
+		return ""
+	}
+	query := parsed.Query()
+	query.Set("page", strconv.Itoa(page))
+	parsed.RawQuery = query.Encode()
+	return fmt.Sprintf("%s://%s%s", protocol, host, parsed.String())
+}
+
 // Marshal encapsulates the passed in object with our encapsulation
 // format.
 func (codec *RadioboxApiCodec) Marshal(object interface{}, options map[string]interface{}) ([]byte, error) {
-	var joinsStr string
-	if joinsValue, ok := options["joins"]; ok {
-		joinsStr = joinsValue.(string)
-	} else {
-		joinsStr = options["input_params"].(objx.Map).Get("joins").Str()
-	}
-	var joins objx.Map
-	if joinsStr != "" {
-		var err error
-		joins, err = objx.FromJSON(joinsStr)
-		if err != nil {
-			log.Print("Could not load joins options: " + err.Error())
-		}
-	}
+	joins := codec.joins(options)
 	constructor := codec.CreateConstructor(options)
 	responseObject := web_responders.CreateResponse(object, joins, constructor)
 	response := constructor(responseObject, object)
 
-	matchedType, ok := options["matched_type"].(string)
-	var baseType string
-	if ok && strings.ContainsRune(matchedType, '+') {
-		baseType = typeCategory + "/" + matchedType[len(codec.ContentType())+1:]
-	} else {
-		baseType = defaultBaseType
+	baseType, err := codec.baseType(options)
+	if err != nil {
+		return nil, err
 	}
-	baseCodec, err := goweb.CodecService.GetCodec(baseType)
+	rawCodec, err := goweb.CodecService.GetCodec(baseType)
 	if err != nil {
 		return nil, err
 	}
+	baseCodec, ok := rawCodec.(Codec)
+	if !ok {
+		return nil, fmt.Errorf("base codec for %s does not support marshaling", baseType)
+	}
 
 	return baseCodec.Marshal(response, options)
 }
 
+// joins resolves the options map CreateResponse uses for field
+// selection, via web_responders.JoinsOptions.  web_responders.Respond
+// now parses the whole query string with bracket syntax
+// (filter[user][name]=bob, sort[]=-id, and so on) into input_params, so
+// that nested map is used directly rather than requiring a single
+// "joins" param holding a JSON blob - though older clients that still
+// send "joins" that way are still supported.
+func (codec *RadioboxApiCodec) joins(options map[string]interface{}) objx.Map {
+	inputParams, _ := options["input_params"].(objx.Map)
+	return web_responders.JoinsOptions(inputParams)
+}
+
+// baseType determines which base codec mime type should be used to
+// encode the envelope.  A suffix-specific RadioboxApiCodec (registered
+// by AddCodecs) already knows its own suffix; the generic instance
+// falls back to parsing matched_type and, failing that, to the
+// client's Accept-header preference order, so wildcard Accept requests
+// still land on a supported encapsulation instead of always defaulting
+// to JSON.
+func (codec *RadioboxApiCodec) baseType(options map[string]interface{}) (string, error) {
+	suffix := codec.suffix
+	if suffix == "" {
+		if matchedType, ok := options["matched_type"].(string); ok && strings.ContainsRune(matchedType, '+') {
+			suffix = matchedType[len(BasicMimeType)+1:]
+		}
+	}
+	if baseType, ok := baseCodecTypes[suffix]; ok {
+		return baseType, nil
+	}
+	if accept, ok := options["accept_order"].([]string); ok {
+		for _, mimeType := range accept {
+			if !strings.HasPrefix(mimeType, BasicMimeType+"+") {
+				continue
+			}
+			if baseType, ok := baseCodecTypes[mimeType[len(BasicMimeType)+1:]]; ok {
+				return baseType, nil
+			}
+		}
+	}
+	return defaultBaseType, nil
+}
+
 // Unmarshal returns an error, because unmarshaling is currently
 // unsupported with this codec.
 func (codec *RadioboxApiCodec) Unmarshal(data []byte, obj interface{}) error {
@@ -100,16 +266,30 @@ func (codec *RadioboxApiCodec) Unmarshal(data []byte, obj interface{}) error {
 }
 
 func (codec *RadioboxApiCodec) ContentType() string {
-	return BasicMimeType
+	if codec.suffix == "" {
+		return BasicMimeType
+	}
+	return BasicMimeType + "+" + codec.suffix
 }
 
 // ContentTypeSupported checks a mime type string to see if this codec
-// can support responses in that format.
+// can support responses in that format.  Every RadioboxApiCodec
+// instance, generic or suffix-specific, claims the whole
+// "application/vnd.radiobox.encapsulated(+*)?" namespace here; it's
+// ContentType() that tells goweb which exact mime type a given
+// instance was registered for.
+//
+// TODO: confirm against stretchr/codecs whether goweb's codec
+// selection actually uses ContentType() to disambiguate between two
+// codecs that both answer ContentTypeSupported for the same request -
+// otherwise the generic (suffix == "") registration may always win by
+// registration order, making the per-suffix registrations in
+// supportedSuffixes dead weight.
 func (codec *RadioboxApiCodec) ContentTypeSupported(contentType string) bool {
 	if index := strings.IndexRune(contentType, '+'); index != -1 {
 		contentType = contentType[:index]
 	}
-	return contentType == codec.ContentType()
+	return contentType == BasicMimeType
 }
 
 func (codec *RadioboxApiCodec) FileExtension() string {
@@ -120,6 +300,45 @@ func (codec *RadioboxApiCodec) CanMarshalWithCallback() bool {
 	return true
 }
 
+// supportedSuffixes lists the encapsulation suffixes that get their own
+// RadioboxApiCodec registration, in addition to the generic one, so
+// that goweb's content negotiation can offer
+// "application/vnd.radiobox.encapsulated+proto" (and friends) directly
+// instead of relying solely on the prefix match in
+// ContentTypeSupported.
+var supportedSuffixes = []string{"proto", "protobuf", "msgpack", "grpc+json", "grpc+proto"}
+
 func AddCodecs() {
 	goweb.CodecService.AddCodec(new(RadioboxApiCodec))
+	for _, suffix := range supportedSuffixes {
+		goweb.CodecService.AddCodec(&RadioboxApiCodec{suffix: suffix})
+	}
+	web_responders.StreamEnvelope = streamEnvelope
+}
+
+// streamEnvelope implements web_responders.StreamEnvelope using the
+// generic RadioboxApiCodec, so SSE frames get wrapped by the same
+// CreateConstructor (meta, per-item links, pagination meta) that a
+// single response gets from Marshal.  Unlike Marshal, it always
+// encodes through defaultBaseType rather than whatever base codec
+// content negotiation landed on: SSE's "data: ...\n\n" framing is a
+// text-line protocol, and a binary encoding like protobuf or msgpack
+// can contain a raw 0x0A byte that would corrupt it, so streaming
+// responses are restricted to the one base codec that's always
+// text-safe.
+func streamEnvelope(options objx.Map) (func(interface{}, interface{}) interface{}, func(interface{}) ([]byte, error)) {
+	codec := new(RadioboxApiCodec)
+	constructor := codec.CreateConstructor(options)
+	marshal := func(frame interface{}) ([]byte, error) {
+		rawCodec, err := goweb.CodecService.GetCodec(defaultBaseType)
+		if err != nil {
+			return nil, err
+		}
+		baseCodec, ok := rawCodec.(Codec)
+		if !ok {
+			return nil, fmt.Errorf("base codec for %s does not support marshaling", defaultBaseType)
+		}
+		return baseCodec.Marshal(frame, options)
+	}
+	return constructor, marshal
 }
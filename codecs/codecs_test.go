@@ -0,0 +1,114 @@
+package codecs
+
+import (
+	"strings"
+	"testing"
+)
+
+type fakePaginator struct {
+	page, perPage int
+	total         int64
+}
+
+func (p fakePaginator) Page() int    { return p.page }
+func (p fakePaginator) PerPage() int { return p.perPage }
+func (p fakePaginator) Total() int64 { return p.total }
+
+func TestPaginationPageURL(t *testing.T) {
+	url := paginationPageURL("https", "example.com", "/widgets?page=1&per_page=10", 3)
+	if !strings.HasPrefix(url, "https://example.com/widgets?") {
+		t.Fatalf("url = %q, want prefix %q", url, "https://example.com/widgets?")
+	}
+	if !strings.Contains(url, "page=3") {
+		t.Errorf("url = %q, want page=3", url)
+	}
+	if !strings.Contains(url, "per_page=10") {
+		t.Errorf("url = %q, want per_page=10 preserved", url)
+	}
+}
+
+func TestAddPaginationMetaMiddlePage(t *testing.T) {
+	meta := map[string]interface{}{}
+	paginator := fakePaginator{page: 2, perPage: 10, total: 35}
+	options := map[string]interface{}{
+		"protocol": "https",
+		"host":     "example.com",
+		"path":     "/widgets?page=2",
+	}
+
+	addPaginationMeta(meta, paginator, options)
+
+	if meta["page"] != 2 || meta["per_page"] != 10 || meta["total"] != int64(35) {
+		t.Fatalf("meta = %#v", meta)
+	}
+	if _, ok := meta["prev"]; !ok {
+		t.Errorf("expected a prev link on a middle page")
+	}
+	if _, ok := meta["next"]; !ok {
+		t.Errorf("expected a next link on a middle page")
+	}
+}
+
+func TestAddPaginationMetaFirstAndLastPage(t *testing.T) {
+	meta := map[string]interface{}{}
+	paginator := fakePaginator{page: 1, perPage: 10, total: 5}
+	options := map[string]interface{}{
+		"protocol": "https",
+		"host":     "example.com",
+		"path":     "/widgets?page=1",
+	}
+
+	addPaginationMeta(meta, paginator, options)
+
+	if _, ok := meta["prev"]; ok {
+		t.Errorf("did not expect a prev link on the first page")
+	}
+	if _, ok := meta["next"]; ok {
+		t.Errorf("did not expect a next link when every item fits on one page")
+	}
+}
+
+func TestAddPaginationMetaNotAPaginator(t *testing.T) {
+	meta := map[string]interface{}{}
+	addPaginationMeta(meta, "not a paginator", map[string]interface{}{})
+
+	if len(meta) != 0 {
+		t.Errorf("meta = %#v, want untouched", meta)
+	}
+}
+
+func TestBaseTypeSuffixSpecific(t *testing.T) {
+	codec := &RadioboxApiCodec{suffix: "msgpack"}
+	baseType, err := codec.baseType(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("baseType: %v", err)
+	}
+	if baseType != "application/x-msgpack" {
+		t.Errorf("baseType = %q, want application/x-msgpack", baseType)
+	}
+}
+
+func TestBaseTypeFallsBackToJSON(t *testing.T) {
+	codec := new(RadioboxApiCodec)
+	baseType, err := codec.baseType(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("baseType: %v", err)
+	}
+	if baseType != defaultBaseType {
+		t.Errorf("baseType = %q, want %q", baseType, defaultBaseType)
+	}
+}
+
+func TestBaseTypeFromAcceptOrder(t *testing.T) {
+	codec := new(RadioboxApiCodec)
+	options := map[string]interface{}{
+		"accept_order": []string{BasicMimeType + "+protobuf", BasicMimeType},
+	}
+	baseType, err := codec.baseType(options)
+	if err != nil {
+		t.Fatalf("baseType: %v", err)
+	}
+	if baseType != "application/vnd.google.protobuf" {
+		t.Errorf("baseType = %q, want application/vnd.google.protobuf", baseType)
+	}
+}
@@ -0,0 +1,279 @@
+package web_responders
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/goweb/context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CompressionOptions controls how Respond compresses response bodies.
+type CompressionOptions struct {
+	// Level is passed directly to whichever compressor was negotiated.
+	// compress/flate and compress/gzip accept -2 through 9 (their
+	// "*Compression" constants) and fail to start on anything else;
+	// brotli uses its own 0-11 quality scale, for which those packages
+	// define no constants, so plain ints are used there.
+	Level int
+
+	// MinSize is the smallest encoded body, in bytes, that will be
+	// compressed.  Bodies smaller than this are written through
+	// unchanged, since the compression overhead isn't worth it for
+	// tiny payloads.
+	MinSize int
+}
+
+// Compression holds the options Respond uses when compressing response
+// bodies.  Operators can reassign this at startup to tune CPU vs
+// bandwidth for their deployment.
+var Compression = CompressionOptions{
+	Level:   gzip.DefaultCompression,
+	MinSize: 1024,
+}
+
+type compressionEncoding int
+
+const (
+	encodingNone compressionEncoding = iota
+	encodingGzip
+	encodingDeflate
+	encodingBrotli
+)
+
+// negotiateEncoding picks the best compressionEncoding named in an
+// Accept-Encoding header, honoring "q" quality values.  Unrecognized
+// encodings and explicit "q=0" are ignored; an empty or all-zero
+// header yields encodingNone, which makes the response writer a
+// transparent passthrough.
+func negotiateEncoding(header string) compressionEncoding {
+	best := encodingNone
+	bestQuality := 0.0
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+
+		var encoding compressionEncoding
+		switch name {
+		case "gzip":
+			encoding = encodingGzip
+		case "deflate":
+			encoding = encodingDeflate
+		case "br":
+			encoding = encodingBrotli
+		default:
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+				quality = parsed
+			}
+		}
+		if quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// compressingResponseWriter wraps an http.ResponseWriter, streaming the
+// body through a gzip/deflate/brotli compressor once enough bytes have
+// been written to clear options.MinSize.  Below that threshold it
+// buffers, so small responses skip compression (and the
+// Content-Encoding header) entirely.  It also buffers the status code
+// passed to WriteHeader until that compress-or-not decision is made, so
+// the Content-Encoding/Vary/Content-Length header mutations always
+// reach the client before the status line does.  It implements
+// http.Flusher and http.Hijacker by delegating to the underlying
+// writer, so it doesn't break streaming or hijacked connections.
+type compressingResponseWriter struct {
+	http.ResponseWriter
+	encoding      compressionEncoding
+	options       CompressionOptions
+	compressor    io.WriteCloser
+	buffer        []byte
+	closed        bool
+	status        int
+	headerWritten bool
+}
+
+func newCompressingResponseWriter(w http.ResponseWriter, encoding compressionEncoding, options CompressionOptions) *compressingResponseWriter {
+	return &compressingResponseWriter{ResponseWriter: w, encoding: encoding, options: options}
+}
+
+// WriteHeader buffers the status code instead of forwarding it
+// immediately, since the encoding headers startCompressing sets (or
+// clears) have to land on the wire before the status line does. The
+// status is actually written by commitHeader, once it's known whether
+// the response is going to be compressed.
+func (w *compressingResponseWriter) WriteHeader(status int) {
+	if w.headerWritten {
+		return
+	}
+	w.status = status
+}
+
+// commitHeader writes the buffered status code (defaulting to 200, the
+// same default net/http uses) through to the underlying writer. It must
+// be called after any header mutations (e.g. in startCompressing) and
+// before the first byte of the body reaches the underlying writer.
+func (w *compressingResponseWriter) commitHeader() {
+	if w.headerWritten {
+		return
+	}
+	w.headerWritten = true
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *compressingResponseWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("web_responders: write to compressingResponseWriter after Close")
+	}
+	if w.compressor != nil {
+		return w.compressor.Write(p)
+	}
+	if w.encoding == encodingNone {
+		w.commitHeader()
+		return w.ResponseWriter.Write(p)
+	}
+	w.buffer = append(w.buffer, p...)
+	if len(w.buffer) < w.options.MinSize {
+		return len(p), nil
+	}
+	if err := w.startCompressing(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// startCompressing is called the first time the buffered body clears
+// MinSize.  It sets the encoding headers, removes the now-inaccurate
+// Content-Length, commits the status line, and flushes the buffer into
+// a freshly created compressor.
+func (w *compressingResponseWriter) startCompressing() error {
+	header := w.ResponseWriter.Header()
+	header.Set("Content-Encoding", w.encoding.name())
+	header.Add("Vary", "Accept-Encoding")
+	header.Del("Content-Length")
+	w.commitHeader()
+
+	compressor, err := w.newCompressor()
+	if err != nil {
+		return err
+	}
+	w.compressor = compressor
+
+	buffered := w.buffer
+	w.buffer = nil
+	_, err = w.compressor.Write(buffered)
+	return err
+}
+
+func (w *compressingResponseWriter) newCompressor() (io.WriteCloser, error) {
+	switch w.encoding {
+	case encodingGzip:
+		return gzip.NewWriterLevel(w.ResponseWriter, w.options.Level)
+	case encodingDeflate:
+		return flate.NewWriter(w.ResponseWriter, w.options.Level)
+	case encodingBrotli:
+		return brotli.NewWriterLevel(w.ResponseWriter, w.options.Level), nil
+	}
+	return nil, errors.New("web_responders: unsupported compression encoding")
+}
+
+func (encoding compressionEncoding) name() string {
+	switch encoding {
+	case encodingGzip:
+		return "gzip"
+	case encodingDeflate:
+		return "deflate"
+	case encodingBrotli:
+		return "br"
+	}
+	return ""
+}
+
+// Flush satisfies http.Flusher, flushing any buffered compressor
+// output before flushing the underlying writer.  A Flush before the
+// body has cleared MinSize forces the compress-or-not decision: the
+// status line and the buffered body are written uncompressed, and so
+// is everything written after it.
+func (w *compressingResponseWriter) Flush() {
+	if w.compressor == nil && !w.headerWritten {
+		w.encoding = encodingNone
+		w.commitHeader()
+		if len(w.buffer) > 0 {
+			buffered := w.buffer
+			w.buffer = nil
+			w.ResponseWriter.Write(buffered)
+		}
+	}
+	if flusher, ok := w.compressor.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack satisfies http.Hijacker by delegating to the underlying
+// writer, so compression doesn't break hijacked connections (e.g.
+// websocket upgrades) that happen to share a handler with compressed
+// responses.
+func (w *compressingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("web_responders: underlying ResponseWriter does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// Close flushes any buffered-but-never-compressed body (for responses
+// that never cleared MinSize) or closes the active compressor.  It is
+// safe to call more than once; writes after Close return an error
+// instead of silently corrupting the stream.
+func (w *compressingResponseWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.compressor != nil {
+		return w.compressor.Close()
+	}
+	w.commitHeader()
+	if len(w.buffer) > 0 {
+		buffered := w.buffer
+		w.buffer = nil
+		_, err := w.ResponseWriter.Write(buffered)
+		return err
+	}
+	return nil
+}
+
+// compressingContext decorates a goweb context.Context so that
+// goweb.API.WriteResponseObject writes through a
+// compressingResponseWriter instead of the raw http.ResponseWriter.
+type compressingContext struct {
+	context.Context
+	writer http.ResponseWriter
+}
+
+func (c compressingContext) HttpResponseWriter() http.ResponseWriter {
+	return c.writer
+}
@@ -0,0 +1,123 @@
+package web_responders
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := map[string]compressionEncoding{
+		"":                     encodingNone,
+		"gzip":                 encodingGzip,
+		"deflate":              encodingDeflate,
+		"br":                   encodingBrotli,
+		"gzip;q=0":             encodingNone,
+		"gzip;q=0.1, br;q=0.9": encodingBrotli,
+		"identity, gzip;q=0.5": encodingGzip,
+		"unsupported-encoding": encodingNone,
+	}
+	for header, expected := range cases {
+		if actual := negotiateEncoding(header); actual != expected {
+			t.Errorf("negotiateEncoding(%q) = %v, want %v", header, actual, expected)
+		}
+	}
+}
+
+func TestCompressingResponseWriterBelowMinSize(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writer := newCompressingResponseWriter(recorder, encodingGzip, CompressionOptions{MinSize: 1024})
+
+	writer.WriteHeader(201)
+	writer.Write([]byte("short body"))
+	writer.Close()
+
+	if recorder.Code != 201 {
+		t.Errorf("status = %d, want 201", recorder.Code)
+	}
+	if recorder.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Content-Encoding = %q, want empty (body never cleared MinSize)", recorder.Header().Get("Content-Encoding"))
+	}
+	if recorder.Body.String() != "short body" {
+		t.Errorf("body = %q, want %q", recorder.Body.String(), "short body")
+	}
+}
+
+// TestCompressingResponseWriterBuffersStatus guards against the
+// wire-corruption bug where WriteHeader forwarded the status straight
+// to the underlying writer before startCompressing's header mutations
+// (Content-Encoding, Vary, Content-Length removal) had a chance to run.
+func TestCompressingResponseWriterBuffersStatus(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writer := newCompressingResponseWriter(recorder, encodingGzip, CompressionOptions{MinSize: 4})
+
+	writer.Header().Set("Content-Length", "999")
+	writer.WriteHeader(201)
+
+	if recorder.Code != 200 {
+		t.Fatalf("status should not have been committed yet, got %d", recorder.Code)
+	}
+
+	if _, err := writer.Write([]byte("a body long enough to compress")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	if recorder.Code != 201 {
+		t.Errorf("status = %d, want 201", recorder.Code)
+	}
+	if recorder.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", recorder.Header().Get("Content-Encoding"))
+	}
+	if recorder.Header().Get("Content-Length") != "" {
+		t.Errorf("Content-Length = %q, want removed", recorder.Header().Get("Content-Length"))
+	}
+	if recorder.Body.Len() == 0 {
+		t.Errorf("body should not be empty")
+	}
+}
+
+func TestCompressingResponseWriterPassthrough(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writer := newCompressingResponseWriter(recorder, encodingNone, CompressionOptions{MinSize: 1024})
+
+	writer.WriteHeader(200)
+	writer.Write([]byte("plain body"))
+	writer.Close()
+
+	if recorder.Body.String() != "plain body" {
+		t.Errorf("body = %q, want %q", recorder.Body.String(), "plain body")
+	}
+	if recorder.Header().Get("Content-Encoding") != "" {
+		t.Errorf("Content-Encoding = %q, want empty", recorder.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestCompressingResponseWriterWriteAfterClose(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writer := newCompressingResponseWriter(recorder, encodingNone, CompressionOptions{MinSize: 1024})
+
+	writer.Close()
+	if _, err := writer.Write([]byte("too late")); err == nil {
+		t.Errorf("Write after Close should return an error")
+	}
+}
+
+func TestCompressingResponseWriterRoundTrip(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	writer := newCompressingResponseWriter(recorder, encodingGzip, CompressionOptions{Level: 1, MinSize: 1})
+
+	body := strings.Repeat("x", 2048)
+	writer.Write([]byte(body))
+	writer.Close()
+
+	if recorder.Body.Len() >= len(body) {
+		t.Errorf("compressed body (%d bytes) should be smaller than the original (%d bytes)", recorder.Body.Len(), len(body))
+	}
+	if !bytes.HasPrefix(recorder.Body.Bytes(), []byte{0x1f, 0x8b}) {
+		t.Errorf("body should start with the gzip magic number")
+	}
+}
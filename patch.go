@@ -0,0 +1,470 @@
+package web_responders
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Radiobox/web_request_readers"
+	"github.com/stretchr/goweb/context"
+	"github.com/stretchr/objx"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Content types recognized by RespondWithPatchErrors, selecting between
+// the two patch formats it supports.
+const (
+	JsonPatchContentType  = "application/json-patch+json"
+	MergePatchContentType = "application/merge-patch+json"
+)
+
+// RespondWithPatchErrors is RespondWithInputErrors' companion for PATCH
+// endpoints.  Rather than expecting a full form-style parameter set, it
+// reads the request body as a JSON Patch (RFC 6902) or JSON Merge Patch
+// (RFC 7396) document - chosen by Content-Type - and applies it
+// directly against data, which must be a pointer to the struct being
+// patched.  Any operation that fails gets an error on notifications,
+// keyed by its JSON Pointer path, and the response is written the same
+// way RespondWithInputErrors writes its own.
+func RespondWithPatchErrors(ctx context.Context, notifications MessageMap, data interface{}) error {
+	body, err := ioutil.ReadAll(ctx.HttpRequest().Body)
+	if err != nil {
+		return err
+	}
+
+	contentType := ctx.HttpRequest().Header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, MergePatchContentType):
+		var patch map[string]interface{}
+		if err := json.Unmarshal(body, &patch); err != nil {
+			notifications.SetInputMessage("", "Request body is not a valid JSON object: "+err.Error())
+			break
+		}
+		applyMergePatch(reflect.ValueOf(data), patch, notifications)
+	case strings.HasPrefix(contentType, JsonPatchContentType):
+		var ops []jsonPatchOp
+		if err := json.Unmarshal(body, &ops); err != nil {
+			notifications.SetInputMessage("", "Request body is not a valid JSON Patch document: "+err.Error())
+			break
+		}
+		applyJsonPatch(data, ops, notifications)
+	default:
+		notifications.SetInputMessage("", fmt.Sprintf("Unsupported patch content type %q", contentType))
+	}
+
+	return Respond(ctx, http.StatusBadRequest, notifications, notifications)
+}
+
+// patchFieldName resolves the key a patch document uses for a field:
+// the "request" tag if present (the same input-side tag addInputErrors
+// consults via web_request_readers.NameAndArgs), otherwise whatever
+// ResponseTag would use for output, so a partial update accepts the
+// same key a client would have seen in a GET of the same resource.
+func patchFieldName(field reflect.StructField) string {
+	if name := field.Tag.Get("request"); name != "" && name != "-" {
+		return name
+	}
+	return ResponseTag(field)
+}
+
+// applyMergePatch shallow-merges a decoded JSON Merge Patch object onto
+// the fields of the struct pointed to by target, resolving each key
+// via patchFieldName.  An explicit JSON null clears the field:
+// SqlNullablePrefix ("Null*") types get Valid set to false, everything
+// else gets its zero value.  Keys with no matching field get an error
+// on notifications, keyed by "/"+key.
+func applyMergePatch(target reflect.Value, patch map[string]interface{}, notifications MessageMap) {
+	consumed := make(map[string]bool, len(patch))
+	mergeStructFields(target, patch, consumed, notifications)
+	for key := range patch {
+		if !consumed[key] {
+			notifications.SetInputMessage("/"+key, "No target field found for this input")
+		}
+	}
+}
+
+func mergeStructFields(target reflect.Value, patch map[string]interface{}, consumed map[string]bool, notifications MessageMap) {
+	if target.Kind() == reflect.Ptr {
+		target = target.Elem()
+	}
+	if target.Kind() != reflect.Struct {
+		return
+	}
+	structType := target.Type()
+
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		fieldValue := target.Field(i)
+
+		if field.Anonymous {
+			mergeStructFields(fieldValue, patch, consumed, notifications)
+			continue
+		}
+		if !unicode.IsUpper(rune(field.Name[0])) {
+			continue
+		}
+
+		name := patchFieldName(field)
+		if name == "-" || consumed[name] {
+			continue
+		}
+		rawValue, ok := patch[name]
+		if !ok {
+			continue
+		}
+		consumed[name] = true
+
+		path := "/" + name
+		if rawValue == nil {
+			if err := clearField(fieldValue); err != nil {
+				notifications.SetInputMessage(path, err.Error())
+			}
+			continue
+		}
+		if err := setFieldFromJSON(fieldValue, rawValue); err != nil {
+			notifications.SetInputMessage(path, err.Error())
+		}
+	}
+}
+
+// clearField handles the "set this to null" half of a merge patch.
+// SqlNullablePrefix types are cleared by setting their Valid field to
+// false, so the underlying value's zero-ness doesn't matter; everything
+// else just gets its zero value.
+func clearField(field reflect.Value) error {
+	if field.Kind() == reflect.Struct {
+		if validField := field.FieldByName("Valid"); validField.IsValid() && validField.Kind() == reflect.Bool && validField.CanSet() {
+			validField.SetBool(false)
+			return nil
+		}
+	}
+	if !field.CanSet() {
+		return errors.New("Field cannot be cleared")
+	}
+	field.Set(reflect.Zero(field.Type()))
+	return nil
+}
+
+// setFieldFromJSON assigns a decoded JSON value onto field.
+// SqlNullablePrefix types get the value written to their namesake
+// field with Valid set to true; RequestValueReceiver types hand off to
+// their own Receive logic, matching addInputErrors; everything else is
+// round-tripped through encoding/json so ordinary type conversions
+// (float64 -> int, etc.) fall out for free.
+func setFieldFromJSON(field reflect.Value, rawValue interface{}) error {
+	if !field.CanAddr() {
+		return errors.New("Field cannot be set")
+	}
+	fieldType := field.Type()
+
+	if field.Kind() == reflect.Struct && strings.HasPrefix(fieldType.Name(), SqlNullablePrefix) {
+		innerName := fieldType.Name()[len(SqlNullablePrefix):]
+		inner := field.FieldByName(innerName)
+		validField := field.FieldByName("Valid")
+		if inner.IsValid() && inner.CanAddr() && validField.IsValid() {
+			encoded, err := json.Marshal(rawValue)
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(encoded, inner.Addr().Interface()); err != nil {
+				return err
+			}
+			validField.SetBool(true)
+			return nil
+		}
+	}
+
+	if receiver, ok := field.Addr().Interface().(web_request_readers.RequestValueReceiver); ok {
+		return receiver.Receive(rawValue)
+	}
+
+	encoded, err := json.Marshal(rawValue)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, field.Addr().Interface())
+}
+
+// jsonPatchOp is a single RFC 6902 operation.
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from"`
+	Value interface{} `json:"value"`
+}
+
+// applyJsonPatch runs ops against a map[string]interface{} projection
+// of data (produced the same way any other response would be, via
+// CreateResponse, so it honors the same struct tags - a JSON Patch
+// targets the same representation a GET of data would return), then
+// translates the result from ResponseTag keys to patchFieldName keys
+// with translateResponseKeys before merging it back onto data's fields
+// with applyMergePatch, which resolves fields via patchFieldName.
+// Without that translation, a field with distinct "request" and
+// "response" tags would project under its response key but never be
+// found by the merge, silently dropping the patch.  Each op that fails
+// - an unresolvable path, a failed "test", or an op against a
+// non-object document - gets an error on notifications keyed by its
+// path, and the ops after it still run against the last good document.
+func applyJsonPatch(data interface{}, ops []jsonPatchOp, notifications MessageMap) {
+	projection, ok := CreateResponse(data).(objx.Map)
+	if !ok {
+		notifications.SetInputMessage("", "JSON Patch is only supported for struct responses")
+		return
+	}
+	doc := map[string]interface{}(projection)
+
+	for _, op := range ops {
+		updated, err := applyJsonPatchOp(doc, op)
+		if err != nil {
+			notifications.SetInputMessage(op.Path, err.Error())
+			continue
+		}
+		doc = updated
+	}
+
+	dataType := reflect.TypeOf(data)
+	applyMergePatch(reflect.ValueOf(data), translateResponseKeys(dataType, doc), notifications)
+}
+
+// translateResponseKeys renames doc's top-level keys from the
+// ResponseTag a CreateResponse projection keys them by to the
+// patchFieldName mergeStructFields looks them up by, using
+// responseToRequestKeys(dataType).  Keys with no corresponding field
+// (there shouldn't be any, since doc was itself built from dataType,
+// but a JSON Patch "add" could introduce one) pass through unchanged,
+// so mergeStructFields still reports them as "No target field found".
+func translateResponseKeys(dataType reflect.Type, doc map[string]interface{}) map[string]interface{} {
+	if dataType.Kind() == reflect.Ptr {
+		dataType = dataType.Elem()
+	}
+	if dataType.Kind() != reflect.Struct {
+		return doc
+	}
+	keys := responseToRequestKeys(dataType)
+	translated := make(map[string]interface{}, len(doc))
+	for key, value := range doc {
+		if requestKey, ok := keys[key]; ok {
+			translated[requestKey] = value
+			continue
+		}
+		translated[key] = value
+	}
+	return translated
+}
+
+// responseToRequestKeys maps every field of dataType from its
+// ResponseTag to its patchFieldName, descending into anonymous fields
+// the same way CreateResponse flattens them into a single top-level
+// map.
+func responseToRequestKeys(dataType reflect.Type) map[string]string {
+	keys := make(map[string]string)
+	for i := 0; i < dataType.NumField(); i++ {
+		field := dataType.Field(i)
+		if field.Anonymous {
+			fieldType := field.Type
+			if fieldType.Kind() == reflect.Ptr {
+				fieldType = fieldType.Elem()
+			}
+			for responseKey, requestKey := range responseToRequestKeys(fieldType) {
+				keys[responseKey] = requestKey
+			}
+			continue
+		}
+		if !unicode.IsUpper(rune(field.Name[0])) {
+			continue
+		}
+		keys[ResponseTag(field)] = patchFieldName(field)
+	}
+	return keys
+}
+
+func applyJsonPatchOp(doc map[string]interface{}, op jsonPatchOp) (map[string]interface{}, error) {
+	var (
+		updated interface{}
+		err     error
+	)
+	switch op.Op {
+	case "add", "replace":
+		updated, err = setAtPointer(doc, parseJSONPointer(op.Path), op.Value)
+	case "remove":
+		updated, err = removeAtPointer(doc, parseJSONPointer(op.Path))
+	case "test":
+		var actual interface{}
+		actual, err = getAtPointer(doc, parseJSONPointer(op.Path))
+		if err == nil && !reflect.DeepEqual(actual, op.Value) {
+			err = fmt.Errorf("value at %q does not match", op.Path)
+		}
+		updated = doc
+	case "move":
+		var value interface{}
+		if value, err = getAtPointer(doc, parseJSONPointer(op.From)); err == nil {
+			if updated, err = removeAtPointer(doc, parseJSONPointer(op.From)); err == nil {
+				updated, err = setAtPointer(updated, parseJSONPointer(op.Path), value)
+			}
+		}
+	case "copy":
+		var value interface{}
+		if value, err = getAtPointer(doc, parseJSONPointer(op.From)); err == nil {
+			updated, err = setAtPointer(doc, parseJSONPointer(op.Path), value)
+		}
+	default:
+		err = fmt.Errorf("unsupported JSON Patch operation %q", op.Op)
+	}
+	if err != nil {
+		return doc, err
+	}
+	result, ok := updated.(map[string]interface{})
+	if !ok {
+		return doc, fmt.Errorf("JSON Patch operation %q must operate on an object document", op.Op)
+	}
+	return result, nil
+}
+
+// parseJSONPointer splits an RFC 6901 JSON Pointer into its reference
+// tokens, unescaping "~1" to "/" and "~0" to "~".
+func parseJSONPointer(pointer string) []string {
+	if pointer == "" {
+		return nil
+	}
+	tokens := strings.Split(strings.TrimPrefix(pointer, "/"), "/")
+	for i, token := range tokens {
+		token = strings.ReplaceAll(token, "~1", "/")
+		token = strings.ReplaceAll(token, "~0", "~")
+		tokens[i] = token
+	}
+	return tokens
+}
+
+// getAtPointer reads the value at tokens within container, which must
+// be built from map[string]interface{} and []interface{} - the shapes
+// encoding/json produces.  Other values, including the objx.Map that
+// CreateResponse produces for a nested struct field, are not descended
+// into; a pointer through one gets a "cannot descend" error.
+func getAtPointer(container interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return container, nil
+	}
+	token, rest := tokens[0], tokens[1:]
+	switch typed := container.(type) {
+	case map[string]interface{}:
+		child, ok := typed[token]
+		if !ok {
+			return nil, fmt.Errorf("no value at %q", token)
+		}
+		return getAtPointer(child, rest)
+	case []interface{}:
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index >= len(typed) {
+			return nil, fmt.Errorf("no value at index %q", token)
+		}
+		return getAtPointer(typed[index], rest)
+	default:
+		return nil, fmt.Errorf("cannot descend into %q", token)
+	}
+}
+
+// setAtPointer returns container with value set at tokens, recursing
+// down to the target and rebuilding each enclosing map/slice on the
+// way back up - which is what lets "add" grow a slice (via the "-"
+// token, or an index equal to its length) without the caller needing
+// to hold a reference to the slice's parent.
+func setAtPointer(container interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	token, rest := tokens[0], tokens[1:]
+	switch typed := container.(type) {
+	case map[string]interface{}:
+		if len(rest) == 0 {
+			typed[token] = value
+			return typed, nil
+		}
+		child, ok := typed[token]
+		if !ok {
+			return nil, fmt.Errorf("no value at %q", token)
+		}
+		updatedChild, err := setAtPointer(child, rest, value)
+		if err != nil {
+			return nil, err
+		}
+		typed[token] = updatedChild
+		return typed, nil
+	case []interface{}:
+		if token == "-" {
+			if len(rest) != 0 {
+				return nil, errors.New(`"-" must be the final token in a pointer`)
+			}
+			return append(typed, value), nil
+		}
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index > len(typed) {
+			return nil, fmt.Errorf("no value at index %q", token)
+		}
+		if len(rest) == 0 {
+			if index == len(typed) {
+				return append(typed, value), nil
+			}
+			typed[index] = value
+			return typed, nil
+		}
+		updatedChild, err := setAtPointer(typed[index], rest, value)
+		if err != nil {
+			return nil, err
+		}
+		typed[index] = updatedChild
+		return typed, nil
+	default:
+		return nil, fmt.Errorf("cannot descend into %q", token)
+	}
+}
+
+// removeAtPointer returns container with the value at tokens removed,
+// rebuilding enclosing maps/slices on the way back up the same way
+// setAtPointer does.
+func removeAtPointer(container interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, errors.New("cannot remove the document root")
+	}
+	token, rest := tokens[0], tokens[1:]
+	switch typed := container.(type) {
+	case map[string]interface{}:
+		if len(rest) == 0 {
+			if _, ok := typed[token]; !ok {
+				return nil, fmt.Errorf("no value at %q", token)
+			}
+			delete(typed, token)
+			return typed, nil
+		}
+		child, ok := typed[token]
+		if !ok {
+			return nil, fmt.Errorf("no value at %q", token)
+		}
+		updatedChild, err := removeAtPointer(child, rest)
+		if err != nil {
+			return nil, err
+		}
+		typed[token] = updatedChild
+		return typed, nil
+	case []interface{}:
+		index, err := strconv.Atoi(token)
+		if err != nil || index < 0 || index >= len(typed) {
+			return nil, fmt.Errorf("no value at index %q", token)
+		}
+		if len(rest) == 0 {
+			return append(typed[:index], typed[index+1:]...), nil
+		}
+		updatedChild, err := removeAtPointer(typed[index], rest)
+		if err != nil {
+			return nil, err
+		}
+		typed[index] = updatedChild
+		return typed, nil
+	default:
+		return nil, fmt.Errorf("cannot descend into %q", token)
+	}
+}
@@ -0,0 +1,136 @@
+package web_responders
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseJSONPointer(t *testing.T) {
+	cases := map[string][]string{
+		"":         nil,
+		"/foo":     {"foo"},
+		"/foo/bar": {"foo", "bar"},
+		"/a~1b":    {"a/b"},
+		"/a~0b":    {"a~b"},
+		"/items/0": {"items", "0"},
+	}
+	for pointer, expected := range cases {
+		actual := parseJSONPointer(pointer)
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("parseJSONPointer(%q) = %#v, want %#v", pointer, actual, expected)
+		}
+	}
+}
+
+func TestApplyJsonPatchOp(t *testing.T) {
+	doc := map[string]interface{}{
+		"name": "bob",
+		"tags": []interface{}{"a", "b"},
+	}
+
+	doc, err := applyJsonPatchOp(doc, jsonPatchOp{Op: "replace", Path: "/name", Value: "alice"})
+	if err != nil {
+		t.Fatalf("replace: %v", err)
+	}
+	if doc["name"] != "alice" {
+		t.Fatalf("replace: name = %v, want alice", doc["name"])
+	}
+
+	doc, err = applyJsonPatchOp(doc, jsonPatchOp{Op: "add", Path: "/tags/-", Value: "c"})
+	if err != nil {
+		t.Fatalf("add: %v", err)
+	}
+	tags := doc["tags"].([]interface{})
+	if len(tags) != 3 || tags[2] != "c" {
+		t.Fatalf("add: tags = %v, want [a b c]", tags)
+	}
+
+	doc, err = applyJsonPatchOp(doc, jsonPatchOp{Op: "copy", From: "/name", Path: "/alias"})
+	if err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if doc["alias"] != "alice" {
+		t.Fatalf("copy: alias = %v, want alice", doc["alias"])
+	}
+
+	doc, err = applyJsonPatchOp(doc, jsonPatchOp{Op: "move", From: "/alias", Path: "/nickname"})
+	if err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if _, ok := doc["alias"]; ok {
+		t.Fatalf("move: alias should have been removed")
+	}
+	if doc["nickname"] != "alice" {
+		t.Fatalf("move: nickname = %v, want alice", doc["nickname"])
+	}
+
+	if _, err := applyJsonPatchOp(doc, jsonPatchOp{Op: "test", Path: "/nickname", Value: "alice"}); err != nil {
+		t.Fatalf("test (matching): %v", err)
+	}
+	if _, err := applyJsonPatchOp(doc, jsonPatchOp{Op: "test", Path: "/nickname", Value: "bob"}); err == nil {
+		t.Fatalf("test (mismatching): expected error")
+	}
+
+	doc, err = applyJsonPatchOp(doc, jsonPatchOp{Op: "remove", Path: "/nickname"})
+	if err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, ok := doc["nickname"]; ok {
+		t.Fatalf("remove: nickname should have been removed")
+	}
+
+	if _, err := applyJsonPatchOp(doc, jsonPatchOp{Op: "bogus", Path: "/name"}); err == nil {
+		t.Fatalf("bogus op: expected error")
+	}
+}
+
+// TestResponseToRequestKeys guards against the tag-mismatch bug where a
+// field with distinct "request" and "response" tags gets projected
+// under its response key by CreateResponse but looked up under its
+// request key by mergeStructFields, silently dropping the patch.
+func TestResponseToRequestKeys(t *testing.T) {
+	type Widget struct {
+		Name string `request:"widget_name" response:"display_name"`
+		Age  int    `response:"age"`
+	}
+
+	keys := responseToRequestKeys(reflect.TypeOf(Widget{}))
+	if keys["display_name"] != "widget_name" {
+		t.Errorf(`keys["display_name"] = %q, want "widget_name"`, keys["display_name"])
+	}
+	if keys["age"] != "age" {
+		t.Errorf(`keys["age"] = %q, want "age"`, keys["age"])
+	}
+}
+
+func TestTranslateResponseKeys(t *testing.T) {
+	type Widget struct {
+		Name string `request:"widget_name" response:"display_name"`
+	}
+
+	doc := map[string]interface{}{"display_name": "alice"}
+	translated := translateResponseKeys(reflect.TypeOf(Widget{}), doc)
+	if _, ok := translated["display_name"]; ok {
+		t.Errorf("translated doc still has response key display_name")
+	}
+	if translated["widget_name"] != "alice" {
+		t.Errorf(`translated["widget_name"] = %v, want "alice"`, translated["widget_name"])
+	}
+}
+
+func TestMergeStructFieldsRespectsRequestTag(t *testing.T) {
+	type Widget struct {
+		Name string `request:"widget_name" response:"display_name"`
+	}
+
+	widget := &Widget{Name: "bob"}
+	consumed := make(map[string]bool)
+	mergeStructFields(reflect.ValueOf(widget), map[string]interface{}{"widget_name": "alice"}, consumed, nil)
+
+	if widget.Name != "alice" {
+		t.Errorf("widget.Name = %q, want %q", widget.Name, "alice")
+	}
+	if !consumed["widget_name"] {
+		t.Errorf(`consumed["widget_name"] = false, want true`)
+	}
+}
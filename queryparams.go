@@ -0,0 +1,125 @@
+package web_responders
+
+import (
+	"github.com/stretchr/objx"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var bracketToken = regexp.MustCompile(`\[([^\]]*)\]`)
+
+// ParseNestedQuery parses bracket-syntax query parameters - e.g.
+// "filter[user][name]=bob&filter[user][age]=30&sort[]=name&sort[]=-id"
+// - into a nested objx.Map equivalent to the same structure decoded
+// from JSON, the way libraries like qson do.  A key with no brackets
+// is left as a flat top-level entry (a single value stays a string; a
+// repeated key becomes []string), so existing flat query strings keep
+// behaving exactly as before.
+//
+// This lets clients express field selection, joins, filters and sorts
+// directly as URL params - "filter[user][name]=bob",
+// "sort[]=-created_at" - instead of inventing a JSON blob for each one.
+func ParseNestedQuery(values url.Values) objx.Map {
+	result := make(objx.Map)
+	for key, vals := range values {
+		base, path := splitNestedKey(key)
+		if len(path) == 0 {
+			if len(vals) == 1 {
+				result[base] = vals[0]
+			} else {
+				result[base] = vals
+			}
+			continue
+		}
+		for _, val := range vals {
+			setNestedQueryValue(result, base, path, val)
+		}
+	}
+	return result
+}
+
+// splitNestedKey splits "filter[user][name]" into its base key
+// ("filter") and its bracketed path segments (["user", "name"]).  A
+// trailing empty segment, as in "sort[]", denotes an array append
+// rather than a named key.
+func splitNestedKey(key string) (string, []string) {
+	index := strings.IndexByte(key, '[')
+	if index == -1 {
+		return key, nil
+	}
+	base := key[:index]
+	matches := bracketToken.FindAllStringSubmatch(key[index:], -1)
+	path := make([]string, len(matches))
+	for i, match := range matches {
+		path[i] = match[1]
+	}
+	return base, path
+}
+
+// JoinsOptions resolves the field-selection options CreateResponse
+// should use from a parsed params map.  It prefers a nested "joins"
+// structure built directly by ParseNestedQuery (e.g. from
+// "joins[author]=full"), falls back to a flat "joins" param holding a
+// JSON blob for older clients, and otherwise falls back to
+// nestedOptions(params) - so bracket-syntax params that parse to
+// nested maps (e.g. "fields[user][name]=1") work as field-selection
+// options even without a "joins" key at all, without also picking up
+// ordinary flat params that merely happen to share a name with a
+// response field.  List params such as "sort[]=-id" are not nested
+// maps and are left out.
+func JoinsOptions(params objx.Map) objx.Map {
+	if nested, ok := params["joins"].(objx.Map); ok {
+		return nested
+	}
+	if joinsStr, ok := params["joins"].(string); ok && joinsStr != "" {
+		if parsed, err := objx.FromJSON(joinsStr); err == nil {
+			return parsed
+		}
+	}
+	return nestedOptions(params)
+}
+
+// nestedOptions filters params down to the entries that are themselves
+// nested objx.Maps, discarding flat string/[]string entries.  Only
+// bracket-syntax sub-keys (e.g. "fields[user][name]=1") produce nested
+// maps, so this is what lets them through as field-selection options
+// while leaving ordinary flat params - which CreateResponse can't
+// interpret as an option and would otherwise panic on - out of the
+// result.
+func nestedOptions(params objx.Map) objx.Map {
+	result := make(objx.Map)
+	for key, value := range params {
+		if nested, ok := value.(objx.Map); ok {
+			result[key] = nested
+		}
+	}
+	return result
+}
+
+// setNestedQueryValue sets value at result[base][path[0]][path[1]]...,
+// creating nested objx.Maps along the way.  A "" path segment (from a
+// "key[]" token) appends to a []interface{} instead of descending into
+// a map; it's only meaningful as the last segment, since query strings
+// don't have a standard way to express an object inside an array
+// element.
+func setNestedQueryValue(result objx.Map, base string, path []string, value string) {
+	if len(path) == 0 {
+		result[base] = value
+		return
+	}
+	segment, rest := path[0], path[1:]
+
+	if segment == "" {
+		list, _ := result[base].([]interface{})
+		result[base] = append(list, value)
+		return
+	}
+
+	child, ok := result[base].(objx.Map)
+	if !ok {
+		child = make(objx.Map)
+		result[base] = child
+	}
+	setNestedQueryValue(child, segment, rest, value)
+}
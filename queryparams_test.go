@@ -0,0 +1,92 @@
+package web_responders
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/stretchr/objx"
+)
+
+func TestParseNestedQuery(t *testing.T) {
+	values, err := url.ParseQuery("filter[user][name]=bob&filter[user][age]=30&sort[]=name&sort[]=-id&page=2")
+	if err != nil {
+		t.Fatalf("ParseQuery: %v", err)
+	}
+
+	parsed := ParseNestedQuery(values)
+
+	filter, ok := parsed["filter"].(objx.Map)
+	if !ok {
+		t.Fatalf("filter = %#v, want objx.Map", parsed["filter"])
+	}
+	user, ok := filter["user"].(objx.Map)
+	if !ok {
+		t.Fatalf("filter[user] = %#v, want objx.Map", filter["user"])
+	}
+	if user["name"] != "bob" {
+		t.Errorf(`filter[user][name] = %v, want "bob"`, user["name"])
+	}
+	if user["age"] != "30" {
+		t.Errorf(`filter[user][age] = %v, want "30"`, user["age"])
+	}
+
+	sort, ok := parsed["sort"].([]interface{})
+	if !ok {
+		t.Fatalf("sort = %#v, want []interface{}", parsed["sort"])
+	}
+	if !reflect.DeepEqual(sort, []interface{}{"name", "-id"}) {
+		t.Errorf("sort = %#v, want [name -id]", sort)
+	}
+
+	if parsed["page"] != "2" {
+		t.Errorf(`page = %v, want "2"`, parsed["page"])
+	}
+}
+
+func TestJoinsOptionsNestedJoins(t *testing.T) {
+	params := objx.Map{
+		"joins": objx.Map{"author": "full"},
+	}
+	joins := JoinsOptions(params)
+	if joins["author"] != "full" {
+		t.Errorf(`joins["author"] = %v, want "full"`, joins["author"])
+	}
+}
+
+func TestJoinsOptionsJSONJoins(t *testing.T) {
+	params := objx.Map{
+		"joins": `{"author":{"full":true}}`,
+	}
+	joins := JoinsOptions(params)
+	author, ok := joins["author"].(objx.Map)
+	if !ok {
+		t.Fatalf("joins[author] = %#v, want objx.Map", joins["author"])
+	}
+	if author["full"] != true {
+		t.Errorf(`joins[author][full] = %v, want true`, author["full"])
+	}
+}
+
+// TestJoinsOptionsIgnoresFlatParams guards against treating ordinary
+// flat query/body params - which CreateResponse can't interpret as a
+// field's sub-options - as joins, which would otherwise panic deep in
+// createStructResponse/createMapResponse.
+func TestJoinsOptionsIgnoresFlatParams(t *testing.T) {
+	params := objx.Map{
+		"status": "active",
+		"name":   "bob",
+		"fields": objx.Map{"name": objx.Map{"only": true}},
+	}
+	joins := JoinsOptions(params)
+
+	if _, ok := joins["status"]; ok {
+		t.Errorf("joins should not contain the flat param %q", "status")
+	}
+	if _, ok := joins["name"]; ok {
+		t.Errorf("joins should not contain the flat param %q", "name")
+	}
+	if _, ok := joins["fields"].(objx.Map); !ok {
+		t.Errorf("joins should keep the nested param %q", "fields")
+	}
+}
@@ -12,6 +12,8 @@ import (
 	"github.com/stretchr/objx"
 	"net/http"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"unicode"
 )
@@ -38,6 +40,13 @@ const SqlNullablePrefix = "Null"
 // (i.e. entries in a slice or map, or fields of a struct) that
 // implement the ResponseValueCreator, and instead just use the return
 // value of their ResponseValue() method.
+//
+// A channel, or any value implementing ResponseStreamer, is treated as
+// a stream of responses rather than a single one: CreateResponse
+// drains it into a slice, running each item through this same
+// pipeline.  Respond recognizes streams earlier and switches to a
+// Server-Sent Events response instead, so this mostly matters when
+// CreateResponse is called directly.
 func CreateResponse(data interface{}, optionList ...interface{}) interface{} {
 	if err, ok := data.(error); ok {
 		return err.Error()
@@ -60,6 +69,25 @@ func CreateResponse(data interface{}, optionList ...interface{}) interface{} {
 
 func createResponse(data interface{}, isSubResponse bool, options objx.Map, constructor func(interface{}, interface{}) interface{}) interface{} {
 
+	// A channel, or anything implementing ResponseStreamer, is drained
+	// into a slice here, with each item going through createResponse
+	// individually as a sub-response.  Respond recognizes the same shape earlier and
+	// switches to SSE mode instead, emitting each item as its own
+	// frame as it's produced rather than waiting to drain the whole
+	// stream; this fallback just keeps CreateResponse itself usable on
+	// streaming values outside of that path (e.g. in tests).
+	if next, ok := asResponseStream(data); ok {
+		items := make([]interface{}, 0)
+		for {
+			item, more := next()
+			if !more {
+				break
+			}
+			items = append(items, createResponse(item, true, options, constructor))
+		}
+		return items
+	}
+
 	// LazyLoad with options
 	if lazyLoader, ok := data.(LazyLoader); ok {
 		lazyLoader.LazyLoad(options)
@@ -153,11 +181,47 @@ func createSliceResponse(value reflect.Value, options objx.Map, constructor func
 	response := make([]interface{}, 0, value.Len())
 	for i := 0; i < value.Len(); i++ {
 		element := value.Index(i)
-		response = append(response, createResponseValue(element, options, constructor))
+		itemResponse := createResponseValue(element, options, constructor)
+		response = append(response, withElementLinks(itemResponse, element, constructor))
 	}
 	return response
 }
 
+// ElementLinksOnly is passed as a constructor's object argument to
+// mean "just resolve element's links", as withElementLinks does,
+// rather than "build the full envelope for this (possibly nil)
+// top-level response".  A plain nil can't distinguish those two calls,
+// since a handler is free to Respond with literal nil data; a
+// constructor should compare its object argument against
+// ElementLinksOnly with ==, not with a nil check.
+var ElementLinksOnly = new(struct{})
+
+// withElementLinks lets each element of a slice response carry its own
+// "links" sub-object, the same way the top-level response does,
+// instead of only the top-level object's relations making it into the
+// payload.  It invokes constructor with ElementLinksOnly as the object
+// argument and merges whatever "links" comes back into element's own
+// response map; anything that isn't an objx.Map (scalars, a
+// ResponseValueCreator's return value, and so on) is left untouched,
+// since there's nowhere to put the links.
+func withElementLinks(itemResponse interface{}, element reflect.Value, constructor func(interface{}, interface{}) interface{}) interface{} {
+	if constructor == nil {
+		return itemResponse
+	}
+	responseMap, ok := itemResponse.(objx.Map)
+	if !ok {
+		return itemResponse
+	}
+	linksResult, ok := constructor(ElementLinksOnly, element.Interface()).(map[string]interface{})
+	if !ok {
+		return itemResponse
+	}
+	if links, ok := linksResult["links"]; ok {
+		responseMap["links"] = links
+	}
+	return responseMap
+}
+
 func ResponseTag(field reflect.StructField) string {
 	var name string
 	if name = field.Tag.Get("response"); name != "" {
@@ -262,6 +326,7 @@ func RespondWithInputErrors(ctx context.Context, notifications MessageMap, data
 	if err != nil {
 		return err
 	}
+	mergeNestedQueryParams(params, ctx)
 	addInputErrors(dataType, params, notifications)
 
 	for key := range params {
@@ -270,17 +335,43 @@ func RespondWithInputErrors(ctx context.Context, notifications MessageMap, data
 	return Respond(ctx, http.StatusBadRequest, notifications, notifications)
 }
 
+// mergeNestedQueryParams parses the request's query string with
+// ParseNestedQuery and merges it into params, without overwriting
+// anything ParseParams already populated from the request body.  This
+// is how bracket-syntax query params (filter[user][name]=bob,
+// sort[]=-id, and so on) reach addInputErrors alongside form values.
+func mergeNestedQueryParams(params objx.Map, ctx context.Context) {
+	for key, value := range ParseNestedQuery(ctx.HttpRequest().URL.Query()) {
+		if !params.Has(key) {
+			params.Set(key, value)
+		}
+	}
+}
+
 // addInputErrors (which, to be honest, should be in the
 // web_request_parsers package) walks through
 func addInputErrors(dataType reflect.Type, params objx.Map, notifications MessageMap) {
+	addInputErrorsWithPath(dataType, params, "", notifications)
+}
+
+// addInputErrorsWithPath is addInputErrors' recursive worker.  path is
+// the dotted notification key prefix built up so far; it's empty at
+// the top level and "parentField" once we've descended into a nested
+// struct field whose params value (from bracket-syntax query params
+// like "filter[name]=bob") is itself a nested objx.Map.
+func addInputErrorsWithPath(dataType reflect.Type, params objx.Map, path string, notifications MessageMap) {
 	for i := 0; i < dataType.NumField(); i++ {
 		field := dataType.Field(i)
 		if field.Anonymous {
-			addInputErrors(field.Type, params, notifications)
+			addInputErrorsWithPath(field.Type, params, path, notifications)
 			continue
 		}
 
 		name, args := web_request_readers.NameAndArgs(dataType.Field(i))
+		key := name
+		if path != "" {
+			key = path + "." + name
+		}
 
 		optional := false
 		for _, arg := range args {
@@ -292,7 +383,7 @@ func addInputErrors(dataType reflect.Type, params objx.Map, notifications Messag
 		value, ok := params[name]
 		if !ok {
 			if !optional {
-				notifications.SetInputMessage(name, "No input for required field")
+				notifications.SetInputMessage(key, "No input for required field")
 			}
 			continue
 		}
@@ -302,8 +393,16 @@ func addInputErrors(dataType reflect.Type, params objx.Map, notifications Messag
 		// map.
 		delete(params, name)
 
-		var emptyValue reflect.Value
 		fieldType := field.Type
+		if nested, ok := value.(objx.Map); ok && fieldType.Kind() == reflect.Struct {
+			addInputErrorsWithPath(fieldType, nested, key, notifications)
+			for leftoverKey := range nested {
+				notifications.SetInputMessage(key+"."+leftoverKey, "No target field found for this input")
+			}
+			continue
+		}
+
+		var emptyValue reflect.Value
 		if fieldType.Kind() == reflect.Ptr {
 			emptyValue = reflect.New(fieldType.Elem())
 		} else {
@@ -317,18 +416,18 @@ func addInputErrors(dataType reflect.Type, params objx.Map, notifications Messag
 		emptyInter := emptyValue.Interface()
 		if validator, ok := emptyInter.(InputValidator); ok {
 			if err := validator.ValidateInput(value); err != nil {
-				notifications.SetInputMessage(name, err.Error())
+				notifications.SetInputMessage(key, err.Error())
 			}
 			continue
 		}
 		if receiver, ok := emptyInter.(web_request_readers.RequestValueReceiver); ok {
 			if err := receiver.Receive(value); err != nil {
-				notifications.SetInputMessage(name, err.Error())
+				notifications.SetInputMessage(key, err.Error())
 			}
 			continue
 		}
 		if !reflect.TypeOf(value).ConvertibleTo(fieldType) {
-			notifications.SetInputMessage(name, "Input is of the wrong type and cannot be converted")
+			notifications.SetInputMessage(key, "Input is of the wrong type and cannot be converted")
 		}
 	}
 }
@@ -345,9 +444,7 @@ func Respond(ctx context.Context, status int, notifications MessageMap, data int
 	if err != nil {
 		return err
 	}
-	if ctx.QueryParams().Has("joins") {
-		params.Set("joins", ctx.QueryValue("joins"))
-	}
+	mergeNestedQueryParams(params, ctx)
 
 	protocol := "http"
 	if ctx.HttpRequest().TLS != nil {
@@ -356,6 +453,26 @@ func Respond(ctx context.Context, status int, notifications MessageMap, data int
 
 	host := ctx.HttpRequest().Host
 
+	// This has to be populated before the stream check below, since
+	// respondWithStream reads it back out via ctx.CodecOptions() to
+	// build the same envelope constructor that a single response gets
+	// from a codec's Marshal (frames themselves are always encoded by
+	// StreamEnvelope's marshal func, not the negotiated base codec).
+	options := ctx.CodecOptions()
+	options.MergeHere(objx.Map{
+		"status":        status,
+		"input_params":  params,
+		"notifications": notifications,
+		"protocol":      protocol,
+		"host":          host,
+		"path":          ctx.HttpRequest().URL.RequestURI(),
+		"accept_order":  acceptOrder(ctx.HttpRequest().Header.Get("Accept")),
+	})
+
+	if next, ok := asResponseStream(data); ok {
+		return respondWithStream(ctx, JoinsOptions(params), notifications, next)
+	}
+
 	if linker, ok := data.(RelatedLinker); ok {
 		linkMap := linker.RelatedLinks()
 		links := make([]string, 0, len(linkMap))
@@ -366,19 +483,58 @@ func Respond(ctx context.Context, status int, notifications MessageMap, data int
 		ctx.HttpResponseWriter().Header().Set("Link", strings.Join(links, ", "))
 	}
 
-	options := ctx.CodecOptions()
-	options.MergeHere(objx.Map{
-		"status":        status,
-		"input_params":  params,
-		"notifications": notifications,
-		"protocol":      protocol,
-		"host":          host,
-	})
-
 	// Right now, this line is commented out to support our joins
 	// logic.  Unfortunately, that means that codecs other than our
 	// custom codecs from this package will not work.  Whoops.
 	// data = CreateResponse(data)
 
-	return goweb.API.WriteResponseObject(ctx, status, data)
+	encoding := negotiateEncoding(ctx.HttpRequest().Header.Get("Accept-Encoding"))
+	compressWriter := newCompressingResponseWriter(ctx.HttpResponseWriter(), encoding, Compression)
+	defer compressWriter.Close()
+
+	return goweb.API.WriteResponseObject(compressingContext{ctx, compressWriter}, status, data)
+}
+
+// acceptOrder parses an Accept header into the mime types it lists,
+// ordered from most to least preferred according to their "q" values
+// (a missing q is treated as 1.0, per RFC 7231).  It's handed to codecs
+// via the "accept_order" option so that, when content negotiation
+// leaves more than one of our registered encapsulations on the table,
+// they can pick the one the client actually asked for first.
+func acceptOrder(header string) []string {
+	if header == "" {
+		return nil
+	}
+	type weightedType struct {
+		mimeType string
+		quality  float64
+	}
+	parts := strings.Split(header, ",")
+	weighted := make([]weightedType, 0, len(parts))
+	for _, part := range parts {
+		fields := strings.Split(part, ";")
+		mimeType := strings.TrimSpace(fields[0])
+		if mimeType == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if parsed, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+				quality = parsed
+			}
+		}
+		weighted = append(weighted, weightedType{mimeType, quality})
+	}
+	sort.SliceStable(weighted, func(i, j int) bool {
+		return weighted[i].quality > weighted[j].quality
+	})
+	order := make([]string, len(weighted))
+	for i, w := range weighted {
+		order[i] = w.mimeType
+	}
+	return order
 }
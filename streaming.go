@@ -0,0 +1,148 @@
+package web_responders
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/goweb/context"
+	"github.com/stretchr/objx"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// StreamHeartbeat is how often Respond emits an SSE heartbeat comment
+// to keep idle streaming connections (and the proxies in between) from
+// timing out.  The timer resets after every real frame, so heartbeats
+// never interleave with a busy stream.
+var StreamHeartbeat = 15 * time.Second
+
+// ResponseStreamer lets a type drive a streaming (Server-Sent Events)
+// response without being backed by a native channel - e.g. a database
+// cursor or a paginated API iterator.  Next returns the next item and
+// true, or a zero value and false once the stream is exhausted.
+type ResponseStreamer interface {
+	Next() (interface{}, bool)
+}
+
+// StreamEnvelope lets a codec plug its response-envelope construction
+// and marshaling into respondWithStream, the same way that codec's
+// Marshal method builds and encodes a single (non-streamed) response.
+// Given the same options objx.Map that ends up in ctx.CodecOptions(),
+// it returns a constructor usable as CreateResponse's constructor
+// argument (so per-item links and pagination meta still apply) and a
+// marshal func that encodes a built frame.  codecs.AddCodecs assigns
+// an implementation whose marshal func always encodes JSON, whatever
+// base codec content negotiation landed on, since each frame has to
+// fit on an SSE "data:" line; if it's left nil, respondWithStream falls back to a
+// bare json.Marshal'd {"notifications", "response"} frame with no
+// "meta" key, the way this package behaved before codecs existed.
+var StreamEnvelope func(options objx.Map) (constructor func(interface{}, interface{}) interface{}, marshal func(interface{}) ([]byte, error))
+
+// asResponseStream recognizes the two shapes CreateResponse and
+// Respond treat as a stream of response items rather than a single
+// response: a native channel, and anything implementing
+// ResponseStreamer.  It returns a pull function that yields one item
+// at a time, and false if data isn't a stream at all.
+func asResponseStream(data interface{}) (func() (interface{}, bool), bool) {
+	if streamer, ok := data.(ResponseStreamer); ok {
+		return streamer.Next, true
+	}
+	value := reflect.ValueOf(data)
+	if value.IsValid() && value.Kind() == reflect.Chan {
+		return func() (interface{}, bool) {
+			item, ok := value.Recv()
+			if !ok {
+				return nil, false
+			}
+			return item.Interface(), true
+		}, true
+	}
+	return nil, false
+}
+
+// respondWithStream switches Respond into SSE mode: it sets the
+// streaming headers, then emits one "data:" frame per item produced by
+// next, each run through CreateResponse (with the same joins every
+// other response gets) and then through StreamEnvelope's constructor
+// and marshal func, so struct tags, LazyLoader, per-item links and
+// pagination meta all apply exactly the way they would for a single
+// response.  Frames are encoded by that marshal func (or json.Marshal),
+// not by the negotiated base codec.  It emits a heartbeat comment
+// whenever the stream is idle for StreamHeartbeat, and returns as soon
+// as next is exhausted or the client disconnects.
+func respondWithStream(ctx context.Context, joins objx.Map, notifications MessageMap, next func() (interface{}, bool)) error {
+	header := ctx.HttpResponseWriter().Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("Connection", "keep-alive")
+
+	var constructor func(interface{}, interface{}) interface{}
+	marshal := json.Marshal
+	if StreamEnvelope != nil {
+		constructor, marshal = StreamEnvelope(ctx.CodecOptions())
+	}
+
+	flusher, _ := ctx.HttpResponseWriter().(http.Flusher)
+
+	// next() may block (e.g. waiting on a channel with no ready
+	// value), so it's pulled on its own goroutine and fed through a
+	// channel alongside the heartbeat ticker and the request's
+	// cancellation, rather than blocking the select loop directly.
+	items := make(chan interface{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(items)
+		for {
+			item, more := next()
+			if !more {
+				return
+			}
+			select {
+			case items <- item:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(StreamHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case item, ok := <-items:
+			if !ok {
+				return nil
+			}
+			responseObject := CreateResponse(item, joins, constructor)
+			var envelope interface{} = objx.Map{
+				"notifications": notifications,
+				"response":      responseObject,
+			}
+			if constructor != nil {
+				envelope = constructor(responseObject, item)
+			}
+			frame, err := marshal(envelope)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(ctx.HttpResponseWriter(), "data: %s\n\n", frame); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			heartbeat.Reset(StreamHeartbeat)
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(ctx.HttpResponseWriter(), ": heartbeat\n\n"); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-ctx.HttpRequest().Context().Done():
+			return ctx.HttpRequest().Context().Err()
+		}
+	}
+}
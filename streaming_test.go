@@ -0,0 +1,70 @@
+package web_responders
+
+import "testing"
+
+func TestAsResponseStreamChannel(t *testing.T) {
+	ch := make(chan interface{}, 2)
+	ch <- "one"
+	ch <- "two"
+	close(ch)
+
+	next, ok := asResponseStream(ch)
+	if !ok {
+		t.Fatalf("asResponseStream(chan) ok = false, want true")
+	}
+
+	var items []interface{}
+	for {
+		item, more := next()
+		if !more {
+			break
+		}
+		items = append(items, item)
+	}
+	if len(items) != 2 || items[0] != "one" || items[1] != "two" {
+		t.Errorf("items = %#v, want [one two]", items)
+	}
+}
+
+type fakeStreamer struct {
+	items []interface{}
+}
+
+func (f *fakeStreamer) Next() (interface{}, bool) {
+	if len(f.items) == 0 {
+		return nil, false
+	}
+	item := f.items[0]
+	f.items = f.items[1:]
+	return item, true
+}
+
+func TestAsResponseStreamResponseStreamer(t *testing.T) {
+	streamer := &fakeStreamer{items: []interface{}{1, 2, 3}}
+
+	next, ok := asResponseStream(streamer)
+	if !ok {
+		t.Fatalf("asResponseStream(ResponseStreamer) ok = false, want true")
+	}
+
+	var sum int
+	for {
+		item, more := next()
+		if !more {
+			break
+		}
+		sum += item.(int)
+	}
+	if sum != 6 {
+		t.Errorf("sum = %d, want 6", sum)
+	}
+}
+
+func TestAsResponseStreamNotAStream(t *testing.T) {
+	if _, ok := asResponseStream("just a string"); ok {
+		t.Errorf("asResponseStream(string) ok = true, want false")
+	}
+	if _, ok := asResponseStream(42); ok {
+		t.Errorf("asResponseStream(int) ok = true, want false")
+	}
+}